@@ -2,36 +2,39 @@ package main
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/gob"
+	"context"
 	"flag"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
 	. "github.com/iotaledger/iota.go/api"
-	"github.com/iotaledger/iota.go/bundle"
 	"github.com/iotaledger/iota.go/pow"
-	"github.com/iotaledger/iota.go/transaction"
-	. "github.com/iotaledger/iota.go/trinary"
-	"io/ioutil"
-	"math/rand"
-	"os"
-	"strings"
-	"time"
-)
 
-var emptySeed = strings.Repeat("9", 81)
+	"github.com/luca-moser/subgen/pkg/daemon"
+	"github.com/luca-moser/subgen/pkg/subgen"
+)
 
 const defaultNode = "https://trinity.iota-tangle.io:14265"
 const defaultTag = "SUBGEN"
 const defaultTxsCount = 50
+const defaultMWM = 14
 
 // flags
 var num = flag.Int("txs", defaultTxsCount, "number of txs of the subtangle")
 var node = flag.String("node", defaultNode, "the node to use")
 var tag = flag.String("tag", defaultTag, "the tag to use")
 var remotePoW = flag.Bool("remote", true, "whether to do remote PoW")
-var broadcastInterval = flag.Int("broadcastInterval", 10, "the interval (ms) between sending off txs of the build subtangle")
 var retain = flag.Bool("retain", false, "whether to indefinitely generate txs and broadcast them up on key press")
-var wideness = flag.Int("wideness", 30, "wideness of the subtangle")
+var wideness = flag.Int("wideness", 30, "wideness of the subtangle, used by the wideness topology")
+var workers = flag.Int("workers", 8, "number of concurrent workers used to broadcast the subtangle")
+var topology = flag.String("topology", "wideness", "tip selection strategy to use: wideness, chain, tree or conflict")
+
+var daemonMode = flag.Bool("daemon", false, "run subgen as a long-lived HTTP daemon instead of a one-shot CLI")
+var daemonAddr = flag.String("daemonAddr", ":8080", "address the daemon HTTP API listens on")
+var jobsDir = flag.String("jobsDir", "./jobs", "directory daemon job snapshots are persisted under")
 
 const snapshotFile = "./subtangle.snap"
 
@@ -41,12 +44,16 @@ func must(err error) {
 	}
 }
 
-type Subtangle = transaction.Transactions
+// Subtangle is an ordered list of transactions making up a subtangle.
+type Subtangle = subgen.Subtangle
 
 func main() {
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		runVerify(os.Args[2:])
+		return
+	}
 
-	gob.Register(Subtangle{})
+	flag.Parse()
 
 	settings := HTTPClientSettings{URI: *node}
 	_, powFunc := pow.GetFastestProofOfWorkImpl()
@@ -56,139 +63,128 @@ func main() {
 	api, err := ComposeAPI(settings)
 	must(err)
 
-	existing := readPersisted()
-	if existing != nil {
-		broadcast(existing, api)
+	if *daemonMode {
+		runDaemon(api)
 		return
 	}
 
-	subtangle := build(api)
-	broadcast(subtangle, api)
-}
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		fmt.Println("\ninterrupted, cancelling in-flight broadcasts...")
+		cancel()
+	}()
 
-func readPersisted() Subtangle {
-	_, err := os.Stat(snapshotFile)
-	switch {
-	case os.IsNotExist(err):
-		return nil
-	default:
-		must(err)
+	strategy, err := tipStrategy(*topology, *wideness)
+	must(err)
+
+	cfg := subgen.Config{
+		NumTxs:       *num,
+		Tag:          *tag,
+		NodeURI:      *node,
+		Wideness:     *wideness,
+		MWM:          defaultMWM,
+		Workers:      *workers,
+		SnapshotPath: snapshotFile,
+		Topology:     strategy,
 	}
-	binSubtangle, err := ioutil.ReadFile(snapshotFile)
+
+	snap, err := subgen.LoadSnapshot(cfg)
 	must(err)
 
-	subtangle := Subtangle{}
-	dec := gob.NewDecoder(bytes.NewReader(binSubtangle))
-	must(dec.Decode(&subtangle))
-	return subtangle
+	var subtangle Subtangle
+	if snap != nil {
+		subtangle, err = subgen.RecordsToSubtangle(snap.Records)
+		must(err)
+		target := snap.Header.NumTxs
+		if target == 0 {
+			target = len(snap.Records)
+		}
+		if len(subtangle) < target {
+			cfg.NumTxs = target
+			subtangle = runResume(api, cfg, subtangle)
+		}
+	} else {
+		subtangle = runBuild(api, cfg)
+	}
+	runBroadcast(ctx, api, subtangle, cfg)
 }
 
-func persist(subtangle Subtangle) {
-	os.Remove(snapshotFile)
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	must(enc.Encode(subtangle))
-	if err := ioutil.WriteFile(snapshotFile, buf.Bytes(), 0755); err != nil {
-		fmt.Println("unable to write snapshot file:", err.Error())
+// tipStrategy constructs the subgen.TipStrategy named by topology, each
+// carrying whichever of the CLI's flags it needs.
+func tipStrategy(topology string, wideness int) (subgen.TipStrategy, error) {
+	switch topology {
+	case "wideness":
+		return subgen.WidenessStrategy{Wideness: wideness}, nil
+	case "chain":
+		return subgen.ChainStrategy{}, nil
+	case "tree":
+		return &subgen.BinaryTreeStrategy{}, nil
+	case "conflict":
+		return &subgen.ConflictStrategy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown -topology %q, want one of wideness, chain, tree, conflict", topology)
 	}
 }
 
-func build(api *API) Subtangle {
-	initialTips, err := api.GetTransactionsToApprove(3)
+// runDaemon starts the HTTP/JSON control API and blocks until it exits.
+func runDaemon(api *API) {
+	mgr, err := daemon.NewManager(api, *jobsDir, *workers)
 	must(err)
 
-	emptyTransfers := bundle.Transfers{bundle.EmptyTransfer}
-	emptyTransfers[0].Tag = *tag
-	subtangleSize := *num
-	var stopGenerating chan struct{}
+	fmt.Printf("daemon listening on %s (jobs persisted under %s)\n", *daemonAddr, *jobsDir)
+	must(http.ListenAndServe(*daemonAddr, mgr.Handler()))
+}
+
+// runBuild drives subgen.Build with a CLI progress bar, supporting -retain
+// mode by stopping generation on a keypress instead of a fixed count.
+func runBuild(api *API, cfg subgen.Config) Subtangle {
+	var stop chan struct{}
 	if *retain {
-		stopGenerating = make(chan struct{})
+		stop = make(chan struct{})
 		fmt.Printf(">retain mode, generating txs indefinitely (hit enter to broadcast)\n")
-		subtangleSize = 1000000
+		cfg.NumTxs = 1000000
 		go func() {
 			reader := bufio.NewReader(os.Stdin)
 			reader.ReadLine()
-			stopGenerating <- struct{}{}
+			stop <- struct{}{}
 		}()
 	}
-	subtangle := Subtangle{}
-	w := *wideness
-out:
-	for i := 0; i < subtangleSize; i++ {
-		if stopGenerating != nil {
-			select {
-			case <-stopGenerating:
-				break out
-			default:
-			}
-		}
-		prep, err := api.PrepareTransfers(emptySeed, emptyTransfers, PrepareTransfersOptions{})
-		must(err)
 
-		// first transaction which connects to the main tangle in the past
-		var trunk, branch Hash
-		if i == 0 {
-			trunk = initialTips.TrunkTransaction
-			branch = initialTips.BranchTransaction
-		} else {
-			// pick random transactions from the last N of our own txs
-			rT := rand.Int()
-			rB := rand.Int()
-			l := len(subtangle)
-			if l < w {
-				trunk = subtangle[rT%len(subtangle)].Hash
-				branch = subtangle[rB%len(subtangle)].Hash
-			} else {
-				trunk = subtangle[l-w+rT%w].Hash
-				branch = subtangle[l-w+rB%w].Hash
-			}
-		}
-		readyTrytes, err := api.AttachToTangle(trunk, branch, 14, prep)
-		must(err)
-		tx, err := transaction.AsTransactionObject(readyTrytes[0])
-		must(err)
-		subtangle = append(subtangle, *tx)
+	subtangle, err := subgen.Build(api, cfg, stop, func(p subgen.Progress) {
 		if *retain {
-			fmt.Printf("\rgenerating txs %d", i+1)
+			fmt.Printf("\rgenerating txs %d", p.Done)
 		} else {
-			fmt.Printf("\rgenerating txs %d/%d", i+1, subtangleSize)
+			fmt.Printf("\rgenerating txs %d/%d", p.Done, p.Total)
 		}
-	}
-
-	// persist the built subtangle
-	persist(subtangle)
-
+	})
+	must(err)
 	return subtangle
 }
 
-func broadcast(subtangle Subtangle, api *API) {
-	defer os.Remove(snapshotFile)
-
-	// add a tx which connect back to the main tangle
-	prep, err := api.PrepareTransfers(emptySeed, bundle.Transfers{bundle.EmptyTransfer}, PrepareTransfersOptions{})
-	must(err)
-
-	tips, err := api.GetTransactionsToApprove(3)
-	must(err)
-
-	readyTrytes, err := api.AttachToTangle(tips.TrunkTransaction, subtangle[len(subtangle)-1].Hash, 14, prep)
+// runResume drives subgen.ResumeBuild with a CLI progress bar, continuing
+// a subtangle a previous run left short of cfg.NumTxs.
+func runResume(api *API, cfg subgen.Config, existing Subtangle) Subtangle {
+	subtangle, err := subgen.ResumeBuild(api, cfg, existing, nil, func(p subgen.Progress) {
+		fmt.Printf("\rresuming generation %d/%d", p.Done, p.Total)
+	})
 	must(err)
+	return subtangle
+}
 
-	tx, err := transaction.AsTransactionObject(readyTrytes[0])
-	must(err)
-	subtangle = append(subtangle, *tx)
-
-	txs := transaction.MustTransactionsToTrytes(subtangle)
-	for i, tx := range txs {
-		tries := 0
-		for ; tries < 5; tries++ {
-			if _, err := api.BroadcastTransactions(tx); err != nil {
-				continue
-			}
-			break
-		}
-		fmt.Printf("\rbroadcasting txs %d/%d", i+1, len(txs))
-		<-time.After(time.Duration(*broadcastInterval) * time.Millisecond)
+// runBroadcast drives subgen.Broadcast with a CLI progress bar.
+func runBroadcast(ctx context.Context, api *API, subtangle Subtangle, cfg subgen.Config) {
+	result, err := subgen.Broadcast(ctx, api, subtangle, cfg, func(p subgen.Progress) {
+		fmt.Printf("\rbroadcasting txs %d/%d", p.Done, p.Total)
+	})
+	switch err {
+	case nil:
+		fmt.Printf("\npublished %d/%d txs to the Tangle\n", result.Acked, result.Total)
+	case context.Canceled:
+		fmt.Printf("\nbroadcast cancelled, progress saved for resume (%d/%d acked)\n", result.Acked, result.Total)
+	default:
+		must(err)
 	}
-	fmt.Printf("\npublished %d txs to the Tangle\n", len(subtangle))
 }
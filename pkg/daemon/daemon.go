@@ -0,0 +1,319 @@
+// Package daemon implements subgen's long-lived HTTP/JSON control API. It
+// runs build+broadcast jobs concurrently against a single shared IOTA node
+// client, persists each job's progress so a daemon restart can pick
+// interrupted jobs back up, and streams progress back to callers as
+// newline-delimited JSON.
+package daemon
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/iotaledger/iota.go/api"
+
+	"github.com/luca-moser/subgen/pkg/subgen"
+)
+
+// ErrNotFound is returned by Stream and Cancel for an unknown job id.
+var ErrNotFound = errors.New("daemon: job not found")
+
+// EventType identifies what a streamed Event reports.
+type EventType string
+
+const (
+	EventGenerating   EventType = "generating"
+	EventBroadcasting EventType = "broadcasting"
+	EventDone         EventType = "done"
+	EventError        EventType = "error"
+	EventCancelled    EventType = "cancelled"
+)
+
+// Event is a single newline-delimited JSON line streamed back from
+// GET /subtangles/{id}.
+type Event struct {
+	Type  EventType `json:"type"`
+	Done  int       `json:"done,omitempty"`
+	Total int       `json:"total,omitempty"`
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// Request is the body of POST /subtangles. Node is optional; if set, the
+// job runs against a client for that node instead of the daemon's default,
+// cached across jobs that share the same node.
+type Request struct {
+	Txs      int    `json:"txs"`
+	Wideness int    `json:"wideness"`
+	Tag      string `json:"tag"`
+	Node     string `json:"node"`
+}
+
+// job tracks one in-flight or finished build+broadcast run.
+type job struct {
+	id     string
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	events   []Event
+	finished bool
+}
+
+func newJob(cancel context.CancelFunc) *job {
+	j := &job{cancel: cancel}
+	j.cond = sync.NewCond(&j.mu)
+	return j
+}
+
+func (j *job) append(e Event) {
+	j.mu.Lock()
+	j.events = append(j.events, e)
+	switch e.Type {
+	case EventDone, EventError, EventCancelled:
+		j.finished = true
+	}
+	j.cond.Broadcast()
+	j.mu.Unlock()
+}
+
+// streamFrom calls emit for every event starting at index from, blocking
+// until a new one arrives, and returns once the job has finished and all
+// of its events have been emitted.
+func (j *job) streamFrom(from int, emit func(Event)) {
+	for {
+		j.mu.Lock()
+		for from >= len(j.events) && !j.finished {
+			j.cond.Wait()
+		}
+		pending := append([]Event(nil), j.events[from:]...)
+		finished := j.finished
+		j.mu.Unlock()
+
+		for _, e := range pending {
+			emit(e)
+		}
+		from += len(pending)
+		if finished && from >= len(j.events) {
+			return
+		}
+	}
+}
+
+// Manager runs subtangle build+broadcast jobs concurrently. Jobs that
+// don't request a specific node share defaultAPI; jobs that do share a
+// client cached per node URI, rather than opening a fresh one per job.
+type Manager struct {
+	defaultAPI *API
+	jobsDir    string
+	workers    int
+
+	mu       sync.Mutex
+	jobs     map[string]*job
+	apiCache map[string]*API
+}
+
+// NewManager creates a Manager rooted at jobsDir and resumes any jobs left
+// behind in it by a previous, now-dead daemon process.
+func NewManager(api *API, jobsDir string, workers int) (*Manager, error) {
+	if err := os.MkdirAll(jobsDir, 0755); err != nil {
+		return nil, err
+	}
+	m := &Manager{defaultAPI: api, jobsDir: jobsDir, workers: workers, jobs: make(map[string]*job), apiCache: make(map[string]*API)}
+
+	entries, err := ioutil.ReadDir(jobsDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".snap") {
+			continue
+		}
+		m.resume(strings.TrimSuffix(entry.Name(), ".snap"))
+	}
+	return m, nil
+}
+
+func (m *Manager) snapshotPath(id string) string {
+	return filepath.Join(m.jobsDir, id+".snap")
+}
+
+// apiFor returns the API client to use for nodeURI, constructing and
+// caching one the first time nodeURI is seen. An empty nodeURI returns
+// the daemon's default client.
+func (m *Manager) apiFor(nodeURI string) (*API, error) {
+	if nodeURI == "" {
+		return m.defaultAPI, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if api, ok := m.apiCache[nodeURI]; ok {
+		return api, nil
+	}
+	api, err := ComposeAPI(HTTPClientSettings{URI: nodeURI})
+	if err != nil {
+		return nil, err
+	}
+	m.apiCache[nodeURI] = api
+	return api, nil
+}
+
+func (m *Manager) resume(id string) {
+	cfg := subgen.Config{Workers: m.workers, SnapshotPath: m.snapshotPath(id)}
+	snap, err := subgen.LoadSnapshot(cfg)
+	if err != nil || snap == nil {
+		return
+	}
+	cfg.Tag = snap.Header.Tag
+	cfg.Wideness = snap.Header.Wideness
+	cfg.MWM = uint64(snap.Header.MWM)
+	cfg.NodeURI = snap.Header.NodeURI
+	cfg.NumTxs = snap.Header.NumTxs
+	if cfg.NumTxs == 0 {
+		cfg.NumTxs = len(snap.Records)
+	}
+
+	subtangle, err := subgen.RecordsToSubtangle(snap.Records)
+	if err != nil {
+		return
+	}
+
+	api, err := m.apiFor(cfg.NodeURI)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := newJob(cancel)
+	m.mu.Lock()
+	m.jobs[id] = j
+	m.mu.Unlock()
+
+	go func() {
+		if len(subtangle) < cfg.NumTxs {
+			var err error
+			subtangle, err = subgen.ResumeBuild(api, cfg, subtangle, ctx.Done(), func(p subgen.Progress) {
+				j.append(Event{Type: EventGenerating, Done: p.Done, Total: p.Total, Time: time.Now()})
+			})
+			if err != nil {
+				j.append(Event{Type: EventError, Error: err.Error(), Time: time.Now()})
+				return
+			}
+			if ctx.Err() != nil {
+				j.append(Event{Type: EventCancelled, Time: time.Now()})
+				return
+			}
+		}
+		m.runBroadcast(ctx, api, j, subtangle, cfg)
+	}()
+}
+
+// Start creates and launches a new job from req, returning its id
+// immediately; the build and broadcast run in the background. It returns
+// an error without starting anything if req is invalid.
+func (m *Manager) Start(req Request) (string, error) {
+	if req.Txs <= 0 {
+		return "", errors.New("daemon: txs must be greater than 0")
+	}
+
+	api, err := m.apiFor(req.Node)
+	if err != nil {
+		return "", err
+	}
+
+	id := newJobID()
+	cfg := subgen.Config{
+		NumTxs:       req.Txs,
+		Tag:          req.Tag,
+		NodeURI:      req.Node,
+		Wideness:     req.Wideness,
+		MWM:          14,
+		Workers:      m.workers,
+		SnapshotPath: m.snapshotPath(id),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := newJob(cancel)
+	m.mu.Lock()
+	m.jobs[id] = j
+	m.mu.Unlock()
+
+	go func() {
+		subtangle, err := subgen.Build(api, cfg, ctx.Done(), func(p subgen.Progress) {
+			j.append(Event{Type: EventGenerating, Done: p.Done, Total: p.Total, Time: time.Now()})
+		})
+		if err != nil {
+			j.append(Event{Type: EventError, Error: err.Error(), Time: time.Now()})
+			return
+		}
+		if ctx.Err() != nil {
+			j.append(Event{Type: EventCancelled, Time: time.Now()})
+			return
+		}
+		m.runBroadcast(ctx, api, j, subtangle, cfg)
+	}()
+
+	return id, nil
+}
+
+func (m *Manager) runBroadcast(ctx context.Context, api *API, j *job, subtangle subgen.Subtangle, cfg subgen.Config) {
+	result, err := subgen.Broadcast(ctx, api, subtangle, cfg, func(p subgen.Progress) {
+		j.append(Event{Type: EventBroadcasting, Done: p.Done, Total: p.Total, Time: time.Now()})
+	})
+	switch {
+	case errors.Is(err, context.Canceled):
+		j.append(Event{Type: EventCancelled, Done: result.Acked, Total: result.Total, Time: time.Now()})
+	case err != nil:
+		// subgen.Broadcast returns a non-nil err whenever any tx, core or
+		// tie-back, failed to broadcast permanently, so this always lands
+		// here rather than the EventDone case below, even though result
+		// may still report most of the subtangle as acked.
+		j.append(Event{Type: EventError, Error: err.Error(), Done: result.Acked, Total: result.Total, Time: time.Now()})
+	default:
+		j.append(Event{Type: EventDone, Done: result.Acked, Total: result.Total, Time: time.Now()})
+	}
+}
+
+// Stream emits job id's events, in order, via emit, blocking until the job
+// finishes.
+func (m *Manager) Stream(id string, emit func(Event)) error {
+	j, ok := m.get(id)
+	if !ok {
+		return ErrNotFound
+	}
+	j.streamFrom(0, emit)
+	return nil
+}
+
+// Cancel stops job id's in-flight build or broadcast via its context.
+func (m *Manager) Cancel(id string) error {
+	j, ok := m.get(id)
+	if !ok {
+		return ErrNotFound
+	}
+	j.cancel()
+	return nil
+}
+
+func (m *Manager) get(id string) (*job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	return j, ok
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,76 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Handler returns an http.Handler implementing subgen's daemon control
+// API:
+//
+//	POST   /subtangles      start a build+broadcast job, body {txs, wideness, tag, node}
+//	GET    /subtangles/{id} stream its progress as newline-delimited JSON
+//	DELETE /subtangles/{id} cancel it
+func (m *Manager) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/subtangles", m.handleCreate)
+	mux.HandleFunc("/subtangles/", m.handleJob)
+	return mux
+}
+
+func (m *Manager) handleCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := m.Start(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		ID string `json:"id"`
+	}{id})
+}
+
+func (m *Manager) handleJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/subtangles/")
+	if id == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		flusher, _ := w.(http.Flusher)
+		enc := json.NewEncoder(w)
+		err := m.Stream(id, func(e Event) {
+			_ = enc.Encode(e)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		}
+	case http.MethodDelete:
+		if err := m.Cancel(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,102 @@
+// Package merkle builds a Merkle tree over IOTA transaction hashes using
+// Curl-P-27 as the hashing function, so that a subtangle can be committed
+// to with a single root and later verified leaf by leaf.
+package merkle
+
+import (
+	"strings"
+
+	"github.com/iotaledger/iota.go/curl"
+	"github.com/iotaledger/iota.go/trinary"
+)
+
+// padHash is the leaf value used to pad the tree to the next power of two.
+var padHash = trinary.Hash(strings.Repeat("9", trinary.HashTrytesSize))
+
+// Tree is a Merkle tree over a set of transaction hashes. Leaves are padded
+// with all-9 trits up to the next power of two; internal nodes are
+// Curl27(left || right).
+type Tree struct {
+	levels [][]trinary.Hash
+}
+
+// New builds a Tree bottom-up from leaves. leaves should be the hashes of
+// the transactions making up the subtangle, in build order.
+func New(leaves []trinary.Hash) *Tree {
+	cur := padToPowerOfTwo(leaves)
+	levels := [][]trinary.Hash{cur}
+	for len(cur) > 1 {
+		next := make([]trinary.Hash, len(cur)/2)
+		for i := range next {
+			next[i] = hashPair(cur[2*i], cur[2*i+1])
+		}
+		levels = append(levels, next)
+		cur = next
+	}
+	return &Tree{levels: levels}
+}
+
+// Root returns the Merkle root of the tree.
+func (t *Tree) Root() trinary.Hash {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// Depth returns the number of levels between a leaf and the root.
+func (t *Tree) Depth() int {
+	return len(t.levels) - 1
+}
+
+// Proof returns the sibling path for the leaf at index, allowing a verifier
+// to recompute the root from that leaf alone via VerifyProof.
+func (t *Tree) Proof(index int) []trinary.Hash {
+	proof := make([]trinary.Hash, 0, len(t.levels)-1)
+	idx := index
+	for level := 0; level < len(t.levels)-1; level++ {
+		proof = append(proof, t.levels[level][idx^1])
+		idx /= 2
+	}
+	return proof
+}
+
+// VerifyProof recomputes the root from leaf and proof and reports whether
+// it matches root.
+func VerifyProof(leaf trinary.Hash, index int, proof []trinary.Hash, root trinary.Hash) bool {
+	hash := leaf
+	idx := index
+	for _, sibling := range proof {
+		if idx%2 == 0 {
+			hash = hashPair(hash, sibling)
+		} else {
+			hash = hashPair(sibling, hash)
+		}
+		idx /= 2
+	}
+	return hash == root
+}
+
+func hashPair(left, right trinary.Hash) trinary.Hash {
+	c := curl.NewCurlP27()
+	must(c.Absorb(trinary.MustTrytesToTrits(left + right)))
+	trits, err := c.Squeeze(trinary.HashTrinarySize)
+	must(err)
+	return trinary.MustTritsToTrytes(trits)
+}
+
+func padToPowerOfTwo(hashes []trinary.Hash) []trinary.Hash {
+	size := 1
+	for size < len(hashes) {
+		size *= 2
+	}
+	padded := make([]trinary.Hash, size)
+	copy(padded, hashes)
+	for i := len(hashes); i < size; i++ {
+		padded[i] = padHash
+	}
+	return padded
+}
+
+func must(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
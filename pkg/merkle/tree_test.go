@@ -0,0 +1,81 @@
+package merkle
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/iotaledger/iota.go/trinary"
+)
+
+// leafHash returns a distinct, valid-looking Curl27 hash for leaf index i,
+// so test trees can be built without needing real transactions.
+func leafHash(i int) trinary.Hash {
+	return trinary.Hash(strings.Repeat("A", i%27+1) + strings.Repeat("9", trinary.HashTrytesSize-(i%27+1)))
+}
+
+func leaves(n int) []trinary.Hash {
+	hashes := make([]trinary.Hash, n)
+	for i := range hashes {
+		hashes[i] = leafHash(i)
+	}
+	return hashes
+}
+
+func TestNewDepthAndPadding(t *testing.T) {
+	tests := []struct {
+		n         int
+		wantDepth int
+	}{
+		{1, 0},
+		{2, 1},
+		{3, 2}, // odd leaf count pads up to 4
+		{4, 2},
+		{5, 3}, // pads up to 8
+		{8, 3},
+	}
+	for _, tt := range tests {
+		tree := New(leaves(tt.n))
+		if tree.Depth() != tt.wantDepth {
+			t.Errorf("New(%d leaves).Depth() = %d, want %d", tt.n, tree.Depth(), tt.wantDepth)
+		}
+	}
+}
+
+func TestNewSingleLeafRootIsTheLeaf(t *testing.T) {
+	leaf := leafHash(0)
+	tree := New([]trinary.Hash{leaf})
+	if tree.Root() != leaf {
+		t.Fatalf("single-leaf root = %s, want %s", tree.Root(), leaf)
+	}
+}
+
+func TestProofVerifyRoundTrip(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 4, 7, 8, 16} {
+		hashes := leaves(n)
+		tree := New(hashes)
+		for i, leaf := range hashes {
+			proof := tree.Proof(i)
+			if !VerifyProof(leaf, i, proof, tree.Root()) {
+				t.Errorf("n=%d: VerifyProof failed for leaf %d", n, i)
+			}
+		}
+	}
+}
+
+func TestVerifyProofRejectsWrongLeaf(t *testing.T) {
+	hashes := leaves(4)
+	tree := New(hashes)
+	proof := tree.Proof(0)
+	if VerifyProof(hashes[1], 0, proof, tree.Root()) {
+		t.Fatal("VerifyProof succeeded with a leaf that doesn't belong at that index")
+	}
+}
+
+func TestVerifyProofRejectsWrongRoot(t *testing.T) {
+	hashes := leaves(4)
+	tree := New(hashes)
+	proof := tree.Proof(0)
+	if VerifyProof(hashes[0], 0, proof, leafHash(99)) {
+		t.Fatal("VerifyProof succeeded against an unrelated root")
+	}
+}
@@ -0,0 +1,80 @@
+package snapshot
+
+// crc32Combine computes the CRC-32 (IEEE) of the concatenation of two
+// buffers from crc1 (the CRC of the first buffer) and crc2/len2 (the CRC
+// and length of the second), without touching either buffer's bytes. It
+// lets MarkState patch the footer CRC around a single changed byte
+// instead of rehashing the whole file on every call.
+//
+// This is the standard GF(2)-matrix CRC combine technique (as used by
+// zlib's crc32_combine): appending n zero-valued bits to a CRC register
+// is a linear transform over GF(2), so shifting crc1 by len2 bytes can be
+// expressed as repeated squaring of that transform rather than replaying
+// len2 actual byte updates.
+const gf2Dim = 32
+
+// gf2MatrixTimes applies the linear transform mat to vec, both expressed
+// over GF(2): mat's row i is XORed into the result wherever bit i of vec
+// is set.
+func gf2MatrixTimes(mat []uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i++ {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+		vec >>= 1
+	}
+	return sum
+}
+
+// gf2MatrixSquare composes mat with itself, i.e. the transform for
+// shifting by twice as many bits.
+func gf2MatrixSquare(square, mat []uint32) {
+	for n := 0; n < gf2Dim; n++ {
+		square[n] = gf2MatrixTimes(mat, mat[n])
+	}
+}
+
+// crc32Combine returns the CRC-32 (IEEE) of buf1+buf2, given crc1 =
+// crc32.ChecksumIEEE(buf1), crc2 = crc32.ChecksumIEEE(buf2) and len2 =
+// len(buf2).
+func crc32Combine(crc1, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1
+	}
+
+	// odd holds the transform for shifting a CRC by one zero bit; even
+	// is repeatedly derived from it by squaring to reach any power of
+	// two in len2's bit length.
+	even := make([]uint32, gf2Dim)
+	odd := make([]uint32, gf2Dim)
+
+	odd[0] = 0xedb88320 // CRC-32 (IEEE) polynomial, reversed
+	row := uint32(1)
+	for n := 1; n < gf2Dim; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+
+	gf2MatrixSquare(even, odd)
+	gf2MatrixSquare(odd, even)
+
+	n := len2
+	for n > 0 {
+		gf2MatrixSquare(even, odd)
+		if n&1 != 0 {
+			crc1 = gf2MatrixTimes(even, crc1)
+		}
+		n >>= 1
+		if n == 0 {
+			break
+		}
+		gf2MatrixSquare(odd, even)
+		if n&1 != 0 {
+			crc1 = gf2MatrixTimes(odd, crc1)
+		}
+		n >>= 1
+	}
+
+	return crc1 ^ crc2
+}
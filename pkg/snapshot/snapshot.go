@@ -0,0 +1,464 @@
+// Package snapshot implements a versioned, append-only on-disk format for
+// persisting a subtangle under construction together with the broadcast
+// state of each of its transactions. Unlike a single gob-encoded blob, a
+// snapshot file stays valid after every append, so a crash mid-generation
+// or mid-broadcast never loses more than the record that was in flight.
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/iotaledger/iota.go/trinary"
+)
+
+// Version is the schema version written by this package. It is bumped
+// whenever the on-disk layout changes incompatibly. Version 1 files are
+// still readable: decode fills in NumTxs from the record count, the
+// same way the rest of the package already treated those files.
+const Version uint8 = 2
+
+var magic = [6]byte{'S', 'G', 'S', 'N', 'A', 'P'}
+
+const footerSize = 4 // trailing CRC32, little-endian
+
+// State records how far a single transaction has progressed through
+// broadcasting.
+type State byte
+
+const (
+	// Pending transactions have been generated but not yet scheduled for
+	// broadcast.
+	Pending State = iota
+	// InFlight transactions are currently being broadcast, including
+	// retries.
+	InFlight
+	// Acked transactions were broadcast successfully and are skipped on
+	// resume.
+	Acked
+)
+
+// Header describes the parameters a subtangle was built with.
+type Header struct {
+	Tag      string
+	Wideness int
+	MWM      int
+	NodeURI  string
+	// NumTxs is the originally-requested tx count, so a resumed Build
+	// knows whether len(Records) reflects a finished subtangle or one cut
+	// short by a crash mid-generation. Not stored in Version 1 files;
+	// decode sets it to the number of records read from such a file.
+	NumTxs int
+}
+
+// Record is a single persisted transaction together with its broadcast
+// state.
+type Record struct {
+	Trytes trinary.Trytes
+	State  State
+}
+
+// Snapshot is a fully-decoded, in-memory view of a persisted file.
+type Snapshot struct {
+	Header  Header
+	Records []Record
+	// Verified is false if the trailing CRC didn't match what was read,
+	// which happens when a crash truncated the file mid-write. Records
+	// that could still be parsed are returned regardless.
+	Verified bool
+	// headerLen is the number of bytes the header occupied on disk,
+	// recorded during decode since it depends on the file's own version
+	// rather than the current package Version.
+	headerLen int
+}
+
+// IsLegacyFormat reports whether data is a pre-versioned gob snapshot
+// rather than one written by this package.
+func IsLegacyFormat(data []byte) bool {
+	return len(data) < len(magic) || !bytes.Equal(data[:len(magic)], magic[:])
+}
+
+// Writer appends records to a snapshot file one at a time, keeping the
+// trailing CRC32 up to date after every call so the file is always
+// independently verifiable.
+type Writer struct {
+	f           *os.File
+	crc         uint32
+	stateOffset []int64
+	// headerLen is the number of bytes the header occupies on disk, the
+	// fixed start of the region prefixCRC tracks.
+	headerLen int64
+
+	// suffixCRC[i]/suffixLen[i] cache the CRC32 and length of everything
+	// strictly after record i's state byte, and prefixCRC/prefixUpto
+	// track a running CRC of everything up to (not including) the state
+	// byte most recently marked. MarkState combines prefixCRC, the new
+	// state byte and suffixCRC[index] via crc32Combine to get the new
+	// full-file CRC in O(log n), instead of rehashing the whole file.
+	//
+	// The suffix cache is only valid for indexes visited in increasing
+	// order since it was built (true of how Broadcast drives MarkState:
+	// once through in order marking InFlight, then again marking
+	// Acked); lastMarked lets MarkState detect when an index goes
+	// backwards and refresh the cache from the file's current contents via
+	// rebuildCache.
+	suffixCRC  []uint32
+	suffixLen  []int64
+	prefixCRC  uint32
+	prefixUpto int64
+	lastMarked int
+}
+
+// Create writes a fresh snapshot file at path with the given header,
+// truncating any existing file.
+func Create(path string, header Header) (*Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{f: f, lastMarked: -1}
+	buf := encodeHeader(header)
+	if _, err := f.Write(buf); err != nil {
+		return nil, err
+	}
+	w.headerLen = int64(len(buf))
+	w.crc = crc32.ChecksumIEEE(buf)
+	w.prefixCRC = w.crc
+	w.prefixUpto = w.headerLen
+	if err := w.writeFooter(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Open reopens an existing snapshot file for appending further records,
+// returning the records already persisted so the caller can resume from
+// where it left off. It refuses to reopen a file whose trailing CRC
+// doesn't match its contents, since appending on top of a corrupted
+// snapshot would make the corruption unrecoverable.
+func Open(path string) (*Writer, []Record, error) {
+	snap, err := Read(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !snap.Verified {
+		return nil, nil, fmt.Errorf("snapshot: %s failed its CRC check, refusing to reopen a corrupted snapshot", path)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	w := &Writer{f: f, headerLen: int64(snap.headerLen)}
+	if err := w.dropFooter(); err != nil {
+		return nil, nil, err
+	}
+
+	// replay the records to recover each one's state-byte offset
+	off := int64(snap.headerLen)
+	for _, rec := range snap.Records {
+		w.stateOffset = append(w.stateOffset, off)
+		off += int64(len(encodeRecord(rec.Trytes, rec.State)))
+	}
+
+	crc, err := w.rebuildCache()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.crc = crc
+	if err := w.writeFooter(); err != nil {
+		return nil, nil, err
+	}
+
+	return w, snap.Records, nil
+}
+
+// Append writes a new record and brings the trailing CRC up to date so the
+// file remains independently verifiable after the call returns.
+func (w *Writer) Append(trytes trinary.Trytes, state State) error {
+	if err := w.dropFooter(); err != nil {
+		return err
+	}
+	off, err := w.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	buf := encodeRecord(trytes, state)
+	w.stateOffset = append(w.stateOffset, off)
+	// a subsequent MarkState must not trust a suffix cache built before
+	// this record existed
+	w.suffixCRC = nil
+	if _, err := w.f.Write(buf); err != nil {
+		return err
+	}
+	w.crc = crc32.Update(w.crc, crc32.IEEETable, buf)
+	return w.writeFooter()
+}
+
+// MarkState overwrites the broadcast state of the record at index in
+// place, without touching its trytes, and brings the trailing CRC up to
+// date. Broadcast calls this twice per tx (InFlight, then Acked), so
+// rather than rehashing the whole file on every call, MarkState combines
+// a running prefix CRC with a cached suffix CRC via crc32Combine; the
+// suffix cache is rebuilt from disk only the first time it's needed and
+// whenever index goes backwards (i.e. a new pass over the records has
+// started).
+func (w *Writer) MarkState(index int, state State) error {
+	if index < 0 || index >= len(w.stateOffset) {
+		return errors.New("snapshot: record index out of range")
+	}
+	if err := w.dropFooter(); err != nil {
+		return err
+	}
+
+	if index <= w.lastMarked || len(w.suffixCRC) != len(w.stateOffset) {
+		crc, err := w.rebuildCache()
+		if err != nil {
+			return err
+		}
+		w.crc = crc
+	}
+
+	if w.prefixUpto < w.stateOffset[index] {
+		gap := make([]byte, w.stateOffset[index]-w.prefixUpto)
+		if _, err := w.f.ReadAt(gap, w.prefixUpto); err != nil && err != io.EOF {
+			return err
+		}
+		w.prefixCRC = crc32.Update(w.prefixCRC, crc32.IEEETable, gap)
+		w.prefixUpto = w.stateOffset[index]
+	}
+
+	if _, err := w.f.WriteAt([]byte{byte(state)}, w.stateOffset[index]); err != nil {
+		return err
+	}
+
+	w.prefixCRC = crc32.Update(w.prefixCRC, crc32.IEEETable, []byte{byte(state)})
+	w.prefixUpto = w.stateOffset[index] + 1
+	w.lastMarked = index
+	w.crc = crc32Combine(w.prefixCRC, w.suffixCRC[index], w.suffixLen[index])
+
+	return w.writeFooter()
+}
+
+// Close closes the underlying file.
+func (w *Writer) Close() error {
+	return w.f.Close()
+}
+
+func (w *Writer) size() (int64, error) {
+	info, err := w.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (w *Writer) dropFooter() error {
+	size, err := w.size()
+	if err != nil {
+		return err
+	}
+	if size < footerSize {
+		return nil
+	}
+	return w.f.Truncate(size - footerSize)
+}
+
+func (w *Writer) writeFooter() error {
+	var b [footerSize]byte
+	binary.LittleEndian.PutUint32(b[:], w.crc)
+	if _, err := w.f.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	_, err := w.f.Write(b[:])
+	return err
+}
+
+// rebuildCache reads the file's current contents once to (re)populate the
+// per-record suffix CRC cache and reset prefix tracking to the start of
+// the records, returning the resulting whole-file CRC.
+func (w *Writer) rebuildCache() (uint32, error) {
+	size, err := w.size()
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, size)
+	if _, err := w.f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	n := len(w.stateOffset)
+	w.suffixCRC = make([]uint32, n)
+	w.suffixLen = make([]int64, n)
+	var tailCRC uint32
+	var tailLen int64
+	for i := n - 1; i >= 0; i-- {
+		end := size
+		if i < n-1 {
+			end = w.stateOffset[i+1] + 1 // include record i+1's state byte
+		}
+		chunk := buf[w.stateOffset[i]+1 : end]
+		tailCRC = crc32Combine(crc32.ChecksumIEEE(chunk), tailCRC, tailLen)
+		tailLen += int64(len(chunk))
+		w.suffixCRC[i] = tailCRC
+		w.suffixLen[i] = tailLen
+	}
+
+	w.prefixCRC = crc32.ChecksumIEEE(buf[:w.headerLen])
+	w.prefixUpto = w.headerLen
+	w.lastMarked = -1
+
+	return crc32.ChecksumIEEE(buf), nil
+}
+
+// Read loads and decodes the snapshot file at path.
+func Read(path string) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decode(data)
+}
+
+func decode(data []byte) (*Snapshot, error) {
+	if IsLegacyFormat(data) {
+		return nil, errors.New("snapshot: not a versioned snapshot file")
+	}
+	if len(data) < len(magic)+1+footerSize {
+		return nil, errors.New("snapshot: file too short")
+	}
+
+	body := data[:len(data)-footerSize]
+	wantCRC := binary.LittleEndian.Uint32(data[len(data)-footerSize:])
+	verified := crc32.ChecksumIEEE(body) == wantCRC
+
+	r := bytes.NewReader(body)
+	if _, err := r.Seek(int64(len(magic)), io.SeekStart); err != nil {
+		return nil, err
+	}
+	version, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != 1 && version != Version {
+		return nil, errors.New("snapshot: unsupported schema version")
+	}
+
+	header, err := decodeHeader(r, version)
+	if err != nil {
+		return nil, err
+	}
+	headerLen := len(body) - r.Len()
+
+	var records []Record
+	for r.Len() > 0 {
+		rec, err := decodeRecord(r)
+		if err != nil {
+			// a crash mid-append can leave one truncated trailing
+			// record; everything before it is still valid
+			break
+		}
+		records = append(records, rec)
+	}
+	if version == 1 {
+		header.NumTxs = len(records)
+	}
+
+	return &Snapshot{Header: *header, Records: records, Verified: verified, headerLen: headerLen}, nil
+}
+
+func encodeHeader(h Header) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(magic[:])
+	buf.WriteByte(Version)
+	writeString(buf, h.Tag)
+	writeUint32(buf, uint32(h.Wideness))
+	writeUint32(buf, uint32(h.MWM))
+	writeString(buf, h.NodeURI)
+	writeUint32(buf, uint32(h.NumTxs))
+	return buf.Bytes()
+}
+
+func decodeHeader(r *bytes.Reader, version uint8) (*Header, error) {
+	tag, err := readString(r)
+	if err != nil {
+		return nil, err
+	}
+	wideness, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	mwm, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	nodeURI, err := readString(r)
+	if err != nil {
+		return nil, err
+	}
+	header := &Header{Tag: tag, Wideness: int(wideness), MWM: int(mwm), NodeURI: nodeURI}
+	if version >= 2 {
+		numTxs, err := readUint32(r)
+		if err != nil {
+			return nil, err
+		}
+		header.NumTxs = int(numTxs)
+	}
+	return header, nil
+}
+
+func encodeRecord(trytes trinary.Trytes, state State) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(byte(state))
+	writeString(buf, string(trytes))
+	return buf.Bytes()
+}
+
+func decodeRecord(r *bytes.Reader) (Record, error) {
+	stateByte, err := r.ReadByte()
+	if err != nil {
+		return Record{}, err
+	}
+	trytes, err := readString(r)
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{Trytes: trinary.Trytes(trytes), State: State(stateByte)}, nil
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUint32(buf, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	n, err := readUint32(r)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func writeUint32(buf *bytes.Buffer, v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	buf.Write(b[:])
+}
+
+func readUint32(r *bytes.Reader) (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b[:]), nil
+}
@@ -0,0 +1,221 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/iotaledger/iota.go/trinary"
+)
+
+func TestHeaderEncodeDecodeRoundTrip(t *testing.T) {
+	header := Header{Tag: "SUBGEN", Wideness: 3, MWM: 14, NodeURI: "https://node.example", NumTxs: 42}
+	buf := encodeHeader(header)
+
+	r := bytes.NewReader(buf)
+	if _, err := r.Seek(int64(len(magic)), 0); err != nil {
+		t.Fatalf("seeking past magic: %v", err)
+	}
+	if _, err := r.ReadByte(); err != nil {
+		t.Fatalf("reading version byte: %v", err)
+	}
+	got, err := decodeHeader(r, Version)
+	if err != nil {
+		t.Fatalf("decodeHeader: %v", err)
+	}
+	if *got != header {
+		t.Fatalf("decodeHeader round-trip = %+v, want %+v", *got, header)
+	}
+}
+
+func TestRecordEncodeDecodeRoundTrip(t *testing.T) {
+	want := Record{Trytes: trinary.Trytes("ABCDEFG999"), State: Acked}
+	buf := encodeRecord(want.Trytes, want.State)
+
+	r := bytes.NewReader(buf)
+	got, err := decodeRecord(r)
+	if err != nil {
+		t.Fatalf("decodeRecord: %v", err)
+	}
+	if got != want {
+		t.Fatalf("decodeRecord round-trip = %+v, want %+v", got, want)
+	}
+}
+
+func TestCreateAppendReadRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.snap")
+
+	w, err := Create(path, Header{Tag: "SUBGEN", Wideness: 2, MWM: 14, NumTxs: 3})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	records := []Record{
+		{Trytes: trinary.Trytes("AAA"), State: Pending},
+		{Trytes: trinary.Trytes("BBB"), State: InFlight},
+		{Trytes: trinary.Trytes("CCC"), State: Acked},
+	}
+	for _, rec := range records {
+		if err := w.Append(rec.Trytes, rec.State); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	snap, err := Read(path)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !snap.Verified {
+		t.Fatal("freshly written snapshot should verify its own CRC")
+	}
+	if snap.Header.Tag != "SUBGEN" || snap.Header.NumTxs != 3 {
+		t.Fatalf("decoded header = %+v", snap.Header)
+	}
+	if len(snap.Records) != len(records) {
+		t.Fatalf("got %d records, want %d", len(snap.Records), len(records))
+	}
+	for i, want := range records {
+		if snap.Records[i] != want {
+			t.Errorf("record %d = %+v, want %+v", i, snap.Records[i], want)
+		}
+	}
+}
+
+func TestMarkStateUpdatesCRCAcrossMultiplePasses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.snap")
+
+	w, err := Create(path, Header{Tag: "SUBGEN", NumTxs: 4})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := w.Append(trinary.Trytes("TX"), Pending); err != nil {
+			t.Fatalf("Append %d: %v", i, err)
+		}
+	}
+
+	// first pass, in increasing order: InFlight
+	for i := 0; i < 4; i++ {
+		if err := w.MarkState(i, InFlight); err != nil {
+			t.Fatalf("MarkState(%d, InFlight): %v", i, err)
+		}
+	}
+	// second pass, in increasing order: Acked
+	for i := 0; i < 4; i++ {
+		if err := w.MarkState(i, Acked); err != nil {
+			t.Fatalf("MarkState(%d, Acked): %v", i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	snap, err := Read(path)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !snap.Verified {
+		t.Fatal("snapshot should still verify its own CRC after repeated MarkState calls")
+	}
+	for i, rec := range snap.Records {
+		if rec.State != Acked {
+			t.Errorf("record %d state = %v, want Acked", i, rec.State)
+		}
+	}
+}
+
+func TestMarkStateOutOfRangeIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.snap")
+	w, err := Create(path, Header{Tag: "SUBGEN", NumTxs: 1})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer w.Close()
+	if err := w.MarkState(0, InFlight); err == nil {
+		t.Fatal("MarkState on an empty snapshot should fail, got nil error")
+	}
+}
+
+func TestIsLegacyFormat(t *testing.T) {
+	if IsLegacyFormat(encodeHeader(Header{})) {
+		t.Fatal("versioned header misidentified as legacy")
+	}
+	if !IsLegacyFormat([]byte("not a snapshot at all")) {
+		t.Fatal("arbitrary data not identified as legacy")
+	}
+	if !IsLegacyFormat(nil) {
+		t.Fatal("empty data not identified as legacy")
+	}
+}
+
+// TestDecodeV1HeaderFillsNumTxsFromRecords covers the version 1 snapshot
+// format, written before Header gained NumTxs: decode should fall back to
+// the persisted record count rather than leaving NumTxs at zero.
+func TestDecodeV1HeaderFillsNumTxsFromRecords(t *testing.T) {
+	buf := new(bytes.Buffer)
+	buf.Write(magic[:])
+	buf.WriteByte(1) // version 1, predates NumTxs
+	writeString(buf, "SUBGEN")
+	writeUint32(buf, 2)  // Wideness
+	writeUint32(buf, 14) // MWM
+	writeString(buf, "")
+	buf.Write(encodeRecord("AAA", Acked))
+	buf.Write(encodeRecord("BBB", Pending))
+
+	var footer [footerSize]byte
+	binary.LittleEndian.PutUint32(footer[:], crc32.ChecksumIEEE(buf.Bytes()))
+	body := append(buf.Bytes(), footer[:]...)
+
+	snap, err := decode(body)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !snap.Verified {
+		t.Fatal("decode should verify a correctly-checksummed v1 file")
+	}
+	if snap.Header.NumTxs != len(snap.Records) {
+		t.Fatalf("v1 header.NumTxs = %d, want %d (len(Records))", snap.Header.NumTxs, len(snap.Records))
+	}
+}
+
+func TestReadRejectsCorruptedCRC(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.snap")
+	w, err := Create(path, Header{Tag: "SUBGEN", NumTxs: 1})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := w.Append(trinary.Trytes("AAA"), Pending); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	// flip a byte in the footer CRC itself, so the recorded CRC no longer
+	// matches the (unmodified) body
+	data[len(data)-1] ^= 0xFF
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	snap, err := Read(path)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if snap.Verified {
+		t.Fatal("snapshot with a corrupted footer CRC should not verify")
+	}
+
+	if _, _, err := Open(path); err == nil {
+		t.Fatal("Open should refuse to reopen a snapshot that fails its CRC check")
+	}
+}
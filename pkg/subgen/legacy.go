@@ -0,0 +1,76 @@
+package subgen
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/iotaledger/iota.go/transaction"
+	"github.com/luca-moser/subgen/pkg/snapshot"
+)
+
+// LoadSnapshot loads the snapshot persisted at cfg.SnapshotPath, if any,
+// transparently upgrading a pre-versioned gob snapshot to the current
+// format in place. It returns nil, nil if no snapshot file exists, and an
+// error if the snapshot is structurally parseable but fails its trailing
+// CRC check, rather than silently resuming from possibly-corrupt data.
+func LoadSnapshot(cfg Config) (*snapshot.Snapshot, error) {
+	data, err := readFileIfExists(cfg.SnapshotPath)
+	if data == nil {
+		return nil, err
+	}
+
+	if snapshot.IsLegacyFormat(data) {
+		return migrateLegacy(data, cfg)
+	}
+
+	snap, err := snapshot.Read(cfg.SnapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	if !snap.Verified {
+		return nil, fmt.Errorf("snapshot: %s failed its CRC check, refusing to resume from a corrupted snapshot", cfg.SnapshotPath)
+	}
+	return snap, nil
+}
+
+// migrateLegacy decodes a gob-encoded Subtangle and rewrites it as a
+// versioned snapshot. None of the old txs carry a broadcast state, so they
+// are all marked Pending: a resumed run re-broadcasts the whole subtangle,
+// which is exactly what the old format did anyway.
+func migrateLegacy(data []byte, cfg Config) (*snapshot.Snapshot, error) {
+	gob.Register(Subtangle{})
+	legacy := Subtangle{}
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&legacy); err != nil {
+		return nil, err
+	}
+
+	header := snapshot.Header{Tag: cfg.Tag, Wideness: cfg.Wideness, MWM: int(cfg.MWM), NodeURI: cfg.NodeURI, NumTxs: cfg.NumTxs}
+	w, err := snapshot.Create(cfg.SnapshotPath, header)
+	if err != nil {
+		return nil, err
+	}
+	for _, tx := range legacy {
+		trytes := transaction.MustTransactionsToTrytes(Subtangle{tx})[0]
+		if err := w.Append(trytes, snapshot.Pending); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return snapshot.Read(cfg.SnapshotPath)
+}
+
+// readFileIfExists returns nil, nil if path does not exist, the file's
+// contents if it does, or a non-nil error on any other failure.
+func readFileIfExists(path string) ([]byte, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return ioutil.ReadFile(path)
+}
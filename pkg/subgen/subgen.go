@@ -0,0 +1,317 @@
+// Package subgen implements subtangle generation and broadcasting: the
+// core logic shared by subgen's one-shot CLI mode and its HTTP daemon
+// mode (see pkg/daemon).
+package subgen
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	. "github.com/iotaledger/iota.go/api"
+	"github.com/iotaledger/iota.go/bundle"
+	"github.com/iotaledger/iota.go/converter"
+	"github.com/iotaledger/iota.go/transaction"
+	. "github.com/iotaledger/iota.go/trinary"
+
+	"github.com/luca-moser/subgen/pkg/merkle"
+	"github.com/luca-moser/subgen/pkg/snapshot"
+	"github.com/luca-moser/subgen/pkg/xfer"
+)
+
+var emptySeed = strings.Repeat("9", 81)
+
+// ArchiveSuffix is appended to cfg.SnapshotPath to name the file a fully
+// successful Broadcast leaves behind, so a later subgen verify run has
+// something on disk to check the subtangle's tie-back commitment
+// against.
+const ArchiveSuffix = ".verified"
+
+// Subtangle is an ordered list of transactions making up a subtangle, the
+// first connecting to the main tangle and the rest to each other.
+type Subtangle = transaction.Transactions
+
+// Config parameterises a single build+broadcast run.
+type Config struct {
+	NumTxs       int
+	Tag          string
+	NodeURI      string
+	Wideness     int
+	MWM          uint64
+	Workers      int
+	SnapshotPath string
+	// Topology selects how each tx (after the first) picks its trunk and
+	// branch. Defaults to WidenessStrategy{Wideness: Wideness} when nil.
+	Topology TipStrategy
+}
+
+// Stage identifies which phase of a run a Progress event describes.
+type Stage string
+
+const (
+	StageGenerating   Stage = "generating"
+	StageBroadcasting Stage = "broadcasting"
+)
+
+// Progress is reported through an onProgress callback so callers (the
+// CLI's progress bar, the daemon's event stream) can observe a run without
+// polling internal state. onProgress may be nil.
+type Progress struct {
+	Stage Stage
+	Done  int
+	Total int
+}
+
+// Result summarises a finished broadcast.
+type Result struct {
+	Acked int
+	Total int
+}
+
+// Build generates cfg.NumTxs transactions forming a subtangle, persisting
+// each one to cfg.SnapshotPath as it is produced so a crash mid-generation
+// only loses the tx that was in flight. If stop is non-nil, generation
+// halts early the next time it is signalled, returning whatever was built
+// so far.
+func Build(api *API, cfg Config, stop <-chan struct{}, onProgress func(Progress)) (Subtangle, error) {
+	initialTips, err := api.GetTransactionsToApprove(3)
+	if err != nil {
+		return nil, err
+	}
+
+	header := snapshot.Header{Tag: cfg.Tag, Wideness: cfg.Wideness, MWM: int(cfg.MWM), NodeURI: cfg.NodeURI, NumTxs: cfg.NumTxs}
+	snapWriter, err := snapshot.Create(cfg.SnapshotPath, header)
+	if err != nil {
+		return nil, err
+	}
+	defer snapWriter.Close()
+
+	return build(api, cfg, snapWriter, Subtangle{}, initialTips.TrunkTransaction, initialTips.BranchTransaction, stop, onProgress)
+}
+
+// ResumeBuild continues generating a subtangle that a prior Build call
+// left incomplete, e.g. because the process crashed mid-generation:
+// existing holds the txs already persisted to cfg.SnapshotPath, which is
+// reopened for appending. If existing already covers cfg.NumTxs it is
+// returned unchanged. Strategies that carry their own state (e.g.
+// BinaryTreeStrategy) restart that state from scratch rather than
+// replaying it, since the frontier itself isn't persisted.
+func ResumeBuild(api *API, cfg Config, existing Subtangle, stop <-chan struct{}, onProgress func(Progress)) (Subtangle, error) {
+	if len(existing) >= cfg.NumTxs {
+		return existing, nil
+	}
+
+	snapWriter, _, err := snapshot.Open(cfg.SnapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	defer snapWriter.Close()
+
+	var trunk0, branch0 Hash
+	if len(existing) == 0 {
+		initialTips, err := api.GetTransactionsToApprove(3)
+		if err != nil {
+			return nil, err
+		}
+		trunk0, branch0 = initialTips.TrunkTransaction, initialTips.BranchTransaction
+	}
+
+	return build(api, cfg, snapWriter, existing, trunk0, branch0, stop, onProgress)
+}
+
+// build generates txs from len(subtangle) up to cfg.NumTxs, appending each
+// to snapWriter as it is produced. trunk0/branch0 are only used for index
+// 0, to tie the very first tx of a fresh subtangle back to the main
+// tangle; callers resuming a non-empty subtangle can pass zero values.
+func build(api *API, cfg Config, snapWriter *snapshot.Writer, subtangle Subtangle, trunk0, branch0 Hash, stop <-chan struct{}, onProgress func(Progress)) (Subtangle, error) {
+	emptyTransfers := bundle.Transfers{bundle.EmptyTransfer}
+	emptyTransfers[0].Tag = cfg.Tag
+
+	strategy := cfg.Topology
+	if strategy == nil {
+		strategy = WidenessStrategy{Wideness: cfg.Wideness}
+	}
+	reuser, _ := strategy.(BundleReuser)
+
+	var lastPrep []Trytes
+out:
+	for i := len(subtangle); i < cfg.NumTxs; i++ {
+		if stop != nil {
+			select {
+			case <-stop:
+				break out
+			default:
+			}
+		}
+
+		var prep []Trytes
+		if i > 0 && reuser != nil && reuser.ReuseBundle(i) && lastPrep != nil {
+			prep = lastPrep
+		} else {
+			p, err := api.PrepareTransfers(emptySeed, emptyTransfers, PrepareTransfersOptions{})
+			if err != nil {
+				return nil, err
+			}
+			prep = p
+			lastPrep = p
+		}
+
+		// first transaction which connects to the main tangle in the past
+		var trunk, branch Hash
+		if i == 0 {
+			trunk, branch = trunk0, branch0
+		} else {
+			trunk, branch = strategy.SelectParents(subtangle, i)
+		}
+
+		readyTrytes, err := api.AttachToTangle(trunk, branch, cfg.MWM, prep)
+		if err != nil {
+			return nil, err
+		}
+		tx, err := transaction.AsTransactionObject(readyTrytes[0])
+		if err != nil {
+			return nil, err
+		}
+		subtangle = append(subtangle, *tx)
+		if err := snapWriter.Append(readyTrytes[0], snapshot.Pending); err != nil {
+			return nil, err
+		}
+		if onProgress != nil {
+			onProgress(Progress{Stage: StageGenerating, Done: i + 1, Total: cfg.NumTxs})
+		}
+	}
+
+	return subtangle, nil
+}
+
+// Broadcast commits to subtangle via a Merkle tree over its tx hashes,
+// attaches a tie-back tx carrying the root back to the main tangle, and
+// concurrently broadcasts everything through a xfer.Manager. Broadcast
+// states already marked Acked in cfg.SnapshotPath (from a previous,
+// interrupted run) are skipped. ctx cancellation stops the run early,
+// leaving the snapshot in place so a later call can resume it. If any tx
+// (core or tie-back) fails to broadcast permanently, Broadcast returns a
+// non-nil error and also leaves the snapshot in place for a retry;
+// otherwise it archives the snapshot under cfg.SnapshotPath+ArchiveSuffix
+// rather than deleting it, so it remains available to verify.
+func Broadcast(ctx context.Context, api *API, subtangle Subtangle, cfg Config, onProgress func(Progress)) (Result, error) {
+	hashes := make([]Hash, len(subtangle))
+	for i, tx := range subtangle {
+		hashes[i] = tx.Hash
+	}
+	tree := merkle.New(hashes)
+
+	depthTrytes, err := converter.ASCIIToTrytes(strconv.Itoa(tree.Depth()))
+	if err != nil {
+		return Result{}, err
+	}
+	tieBackTransfer := bundle.EmptyTransfer
+	tieBackTransfer.Message = string(tree.Root()) + depthTrytes
+
+	// add a tx which connects back to the main tangle
+	prep, err := api.PrepareTransfers(emptySeed, bundle.Transfers{tieBackTransfer}, PrepareTransfersOptions{})
+	if err != nil {
+		return Result{}, err
+	}
+
+	tips, err := api.GetTransactionsToApprove(3)
+	if err != nil {
+		return Result{}, err
+	}
+
+	readyTrytes, err := api.AttachToTangle(tips.TrunkTransaction, subtangle[len(subtangle)-1].Hash, cfg.MWM, prep)
+	if err != nil {
+		return Result{}, err
+	}
+
+	coreTxs := transaction.MustTransactionsToTrytes(subtangle)
+
+	snapWriter, existing, err := snapshot.Open(cfg.SnapshotPath)
+	if err != nil {
+		return Result{}, err
+	}
+	defer snapWriter.Close()
+
+	mgr := xfer.New(ctx, api, cfg.Workers)
+	defer mgr.Close()
+
+	// the tie-back tx is cheap to resend and depends on tips that have
+	// likely moved on since a prior attempt, so it is always rebroadcast
+	// rather than tracked in the snapshot
+	tieBackXfer := mgr.Schedule(readyTrytes[0])
+
+	transfers := make([]*xfer.Transfer, len(coreTxs))
+	for i, tx := range coreTxs {
+		if i < len(existing) && existing[i].State == snapshot.Acked {
+			continue
+		}
+		if err := snapWriter.MarkState(i, snapshot.InFlight); err != nil {
+			return Result{}, err
+		}
+		transfers[i] = mgr.Schedule(tx)
+	}
+
+	var acked, failed int
+	for i, t := range transfers {
+		if t == nil {
+			acked++
+			continue
+		}
+		select {
+		case <-t.Done():
+			if err := t.Err(); err != nil {
+				failed++
+				continue
+			}
+			if err := snapWriter.MarkState(i, snapshot.Acked); err != nil {
+				return Result{}, err
+			}
+			acked++
+			if onProgress != nil {
+				onProgress(Progress{Stage: StageBroadcasting, Done: acked, Total: len(coreTxs)})
+			}
+		case <-ctx.Done():
+			return Result{Acked: acked, Total: len(coreTxs) + 1}, ctx.Err()
+		}
+	}
+
+	select {
+	case <-tieBackXfer.Done():
+		if err := tieBackXfer.Err(); err != nil {
+			failed++
+		} else {
+			acked++
+		}
+	case <-ctx.Done():
+		return Result{Acked: acked, Total: len(coreTxs) + 1}, ctx.Err()
+	}
+
+	result := Result{Acked: acked, Total: len(coreTxs) + 1}
+	if failed > 0 {
+		return result, fmt.Errorf("subgen: %d/%d txs failed to broadcast permanently, snapshot kept at %s for retry", failed, result.Total, cfg.SnapshotPath)
+	}
+
+	// every tx, including the tie-back, acked: the snapshot is consumed
+	// and pointless to resume, but verify still needs it, so archive
+	// rather than delete it
+	if err := os.Rename(cfg.SnapshotPath, cfg.SnapshotPath+ArchiveSuffix); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// RecordsToSubtangle reconstructs a Subtangle from persisted snapshot
+// records, e.g. to resume broadcasting after a restart.
+func RecordsToSubtangle(records []snapshot.Record) (Subtangle, error) {
+	subtangle := make(Subtangle, len(records))
+	for i, rec := range records {
+		tx, err := transaction.AsTransactionObject(rec.Trytes)
+		if err != nil {
+			return nil, err
+		}
+		subtangle[i] = *tx
+	}
+	return subtangle, nil
+}
@@ -0,0 +1,104 @@
+package subgen
+
+import (
+	"math/rand"
+
+	. "github.com/iotaledger/iota.go/trinary"
+)
+
+// TipStrategy selects the trunk and branch transactions that the i-th
+// transaction of a subtangle under construction attaches to. i is always
+// greater than 0: the very first transaction always ties back to the two
+// tips fetched from the main tangle, before any strategy runs.
+type TipStrategy interface {
+	SelectParents(subtangle Subtangle, i int) (trunk, branch Hash)
+}
+
+// BundleReuser is implemented by TipStrategy strategies that want Build to
+// reuse the previous iteration's prepared bundle trytes for index i
+// instead of preparing a fresh one, e.g. to create a genuine double-spend:
+// an identical bundle attached to two different tips.
+type BundleReuser interface {
+	ReuseBundle(i int) bool
+}
+
+// WidenessStrategy is the original strategy: trunk and branch are picked
+// at random from the last Wideness txs of the subtangle, or all of them
+// while there are fewer than that.
+type WidenessStrategy struct {
+	Wideness int
+}
+
+func (s WidenessStrategy) SelectParents(subtangle Subtangle, i int) (Hash, Hash) {
+	w := s.Wideness
+	rT, rB := rand.Int(), rand.Int()
+	l := len(subtangle)
+	if l < w {
+		return subtangle[rT%l].Hash, subtangle[rB%l].Hash
+	}
+	return subtangle[l-w+rT%w].Hash, subtangle[l-w+rB%w].Hash
+}
+
+// ChainStrategy produces a single long chain: trunk is always the
+// immediately preceding tx and branch is always the very first one, for
+// stress-testing sequential confirmation.
+type ChainStrategy struct{}
+
+func (ChainStrategy) SelectParents(subtangle Subtangle, i int) (Hash, Hash) {
+	return subtangle[len(subtangle)-1].Hash, subtangle[0].Hash
+}
+
+// BinaryTreeStrategy produces a balanced tree of depth log2(n): whenever
+// the two most recent unconsumed txs in the frontier are roots of subtrees
+// of equal height, the next tx merges them and is itself queued as the root
+// of a subtree one level higher; otherwise it attaches as an ordinary leaf
+// to the subtangle's first tx. This converges the whole subtangle toward a
+// single tip, the same way the Merkle tree in pkg/merkle is built
+// bottom-up.
+type BinaryTreeStrategy struct {
+	frontier []int
+	// heights[k] is the height of the subtree rooted at frontier[k]
+	heights []int
+}
+
+func (s *BinaryTreeStrategy) SelectParents(subtangle Subtangle, i int) (Hash, Hash) {
+	n := len(s.frontier)
+	if n >= 2 && s.heights[n-1] == s.heights[n-2] {
+		trunkIdx, branchIdx := s.frontier[n-2], s.frontier[n-1]
+		height := s.heights[n-1] + 1
+		s.frontier = append(s.frontier[:n-2], i)
+		s.heights = append(s.heights[:n-2], height)
+		return subtangle[trunkIdx].Hash, subtangle[branchIdx].Hash
+	}
+
+	// no two subtrees of equal height to merge yet: attach as a leaf and
+	// queue ourselves for a future merge.
+	s.frontier = append(s.frontier, i)
+	s.heights = append(s.heights, 0)
+	return subtangle[0].Hash, subtangle[0].Hash
+}
+
+// ConflictStrategy intentionally creates double-spends: every second tx
+// reuses the bundle prepared for its predecessor (see BundleReuser) but
+// attaches it to a different branch, so the two conflict instead of one
+// confirming the other.
+type ConflictStrategy struct {
+	lastTrunk, lastBranch Hash
+}
+
+func (s *ConflictStrategy) SelectParents(subtangle Subtangle, i int) (Hash, Hash) {
+	l := len(subtangle)
+	if i%2 == 1 {
+		s.lastTrunk = subtangle[l-1].Hash
+		s.lastBranch = subtangle[rand.Intn(l)].Hash
+		return s.lastTrunk, s.lastBranch
+	}
+	// the conflicting half of the pair: same trunk, different branch
+	return s.lastTrunk, subtangle[rand.Intn(l)].Hash
+}
+
+// ReuseBundle reports whether index i should reuse the previous index's
+// prepared bundle rather than a freshly prepared one.
+func (s *ConflictStrategy) ReuseBundle(i int) bool {
+	return i%2 == 0
+}
@@ -0,0 +1,190 @@
+// Package xfer implements a concurrent transfer manager that broadcasts
+// transaction trytes to an IOTA node through a bounded worker pool,
+// applying exponential backoff between retries, deduplicating identical
+// trytes so in-flight schedules coalesce, and honouring context
+// cancellation from the caller.
+package xfer
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	. "github.com/iotaledger/iota.go/api"
+	. "github.com/iotaledger/iota.go/trinary"
+)
+
+// BackoffConfig configures the delay applied between broadcast retries.
+type BackoffConfig struct {
+	// InitialDelay is the delay before the first retry.
+	InitialDelay time.Duration
+	// MaxDelay caps the delay between retries.
+	MaxDelay time.Duration
+	// Factor is the multiplier applied to the delay after each retry.
+	Factor float64
+	// MaxRetries is the number of retries attempted before giving up.
+	MaxRetries int
+}
+
+// DefaultBackoff is used by New.
+var DefaultBackoff = BackoffConfig{
+	InitialDelay: 200 * time.Millisecond,
+	MaxDelay:     5 * time.Second,
+	Factor:       2,
+	MaxRetries:   5,
+}
+
+// Transfer is a handle to a single scheduled broadcast.
+type Transfer struct {
+	// Trytes is the transaction trytes this Transfer was scheduled with.
+	Trytes Trytes
+
+	done chan struct{}
+	once sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+func newTransfer(tx Trytes) *Transfer {
+	return &Transfer{Trytes: tx, done: make(chan struct{})}
+}
+
+// Done returns a channel which is closed once the transfer has either
+// succeeded, permanently failed or been cancelled.
+func (t *Transfer) Done() <-chan struct{} { return t.done }
+
+// Err returns the terminal error of the transfer, if any. It is only
+// meaningful after Done() has been closed.
+func (t *Transfer) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+func (t *Transfer) finish(err error) {
+	t.mu.Lock()
+	t.err = err
+	t.mu.Unlock()
+	t.once.Do(func() { close(t.done) })
+}
+
+// Manager parallelises broadcasting of transaction trytes across a pool of
+// workers. It retries failed broadcasts with exponential backoff and
+// deduplicates identical trytes so that scheduling the same transfer twice
+// while the first is still in flight returns the same handle instead of
+// broadcasting it again.
+type Manager struct {
+	api     *API
+	backoff BackoffConfig
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	queue chan *Transfer
+	wg    sync.WaitGroup
+
+	mu       sync.Mutex
+	inFlight map[Trytes]*Transfer
+}
+
+// New creates a Manager broadcasting through api using workers concurrent
+// goroutines and the DefaultBackoff configuration. The Manager stops
+// accepting new broadcasts and unwinds outstanding retries once ctx is
+// cancelled.
+func New(ctx context.Context, api *API, workers int) *Manager {
+	return NewWithBackoff(ctx, api, workers, DefaultBackoff)
+}
+
+// NewWithBackoff is like New but allows overriding the backoff behaviour.
+func NewWithBackoff(ctx context.Context, api *API, workers int, backoff BackoffConfig) *Manager {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	m := &Manager{
+		api:      api,
+		backoff:  backoff,
+		ctx:      ctx,
+		cancel:   cancel,
+		queue:    make(chan *Transfer, workers*4),
+		inFlight: make(map[Trytes]*Transfer),
+	}
+	for i := 0; i < workers; i++ {
+		m.wg.Add(1)
+		go m.work()
+	}
+	return m
+}
+
+// Schedule enqueues tx for broadcasting and returns a handle to track its
+// progress. Scheduling identical trytes while the first schedule is still
+// in flight coalesces onto the same Transfer rather than broadcasting it
+// twice.
+func (m *Manager) Schedule(tx Trytes) *Transfer {
+	m.mu.Lock()
+	if existing, ok := m.inFlight[tx]; ok {
+		m.mu.Unlock()
+		return existing
+	}
+	t := newTransfer(tx)
+	m.inFlight[tx] = t
+	m.mu.Unlock()
+
+	select {
+	case m.queue <- t:
+	case <-m.ctx.Done():
+		m.mu.Lock()
+		delete(m.inFlight, tx)
+		m.mu.Unlock()
+		t.finish(m.ctx.Err())
+	}
+	return t
+}
+
+// Close stops accepting new work and waits for all workers to drain. Any
+// retry still waiting on its backoff delay is cancelled immediately.
+func (m *Manager) Close() {
+	close(m.queue)
+	m.cancel()
+	m.wg.Wait()
+}
+
+func (m *Manager) work() {
+	defer m.wg.Done()
+	for t := range m.queue {
+		m.broadcast(t)
+	}
+}
+
+func (m *Manager) broadcast(t *Transfer) {
+	defer func() {
+		m.mu.Lock()
+		delete(m.inFlight, t.Trytes)
+		m.mu.Unlock()
+	}()
+
+	delay := m.backoff.InitialDelay
+	var lastErr error
+	for attempt := 0; attempt <= m.backoff.MaxRetries; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-m.ctx.Done():
+				timer.Stop()
+				t.finish(m.ctx.Err())
+				return
+			}
+			delay = time.Duration(math.Min(float64(m.backoff.MaxDelay), float64(delay)*m.backoff.Factor))
+		}
+		if _, err := m.api.BroadcastTransactions(t.Trytes); err != nil {
+			lastErr = err
+			continue
+		}
+		t.finish(nil)
+		return
+	}
+	t.finish(lastErr)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	. "github.com/iotaledger/iota.go/api"
+	"github.com/iotaledger/iota.go/converter"
+	"github.com/iotaledger/iota.go/transaction"
+	. "github.com/iotaledger/iota.go/trinary"
+
+	"github.com/luca-moser/subgen/pkg/merkle"
+	"github.com/luca-moser/subgen/pkg/snapshot"
+	"github.com/luca-moser/subgen/pkg/subgen"
+)
+
+// runVerify implements the "subgen verify" subcommand: it recomputes the
+// Merkle root over a persisted subtangle and confirms it matches the root
+// embedded in the tie-back transaction anchoring it to the main tangle.
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	snapshotPath := fs.String("snapshot", snapshotFile+subgen.ArchiveSuffix, "path to the persisted subtangle snapshot (defaults to the archive a successful broadcast leaves behind)")
+	tailHash := fs.String("tail", "", "tail hash of the tie-back transaction to fetch from the node")
+	nodeURI := fs.String("node", defaultNode, "the node to use")
+	must(fs.Parse(args))
+
+	if *tailHash == "" {
+		fmt.Println("verify: -tail is required")
+		os.Exit(1)
+	}
+
+	snap, err := snapshot.Read(*snapshotPath)
+	must(err)
+	subtangle, err := subgen.RecordsToSubtangle(snap.Records)
+	must(err)
+
+	hashes := make([]Hash, len(subtangle))
+	for i, tx := range subtangle {
+		hashes[i] = tx.Hash
+	}
+	tree := merkle.New(hashes)
+
+	api, err := ComposeAPI(HTTPClientSettings{URI: *nodeURI})
+	must(err)
+
+	trytes, err := api.GetTrytes(*tailHash)
+	must(err)
+	if len(trytes) == 0 {
+		fmt.Println("verify: tie-back transaction not found on node")
+		os.Exit(1)
+	}
+	tieBack, err := transaction.AsTransactionObject(trytes[0])
+	must(err)
+
+	fragment := tieBack.SignatureMessageFragment
+	if len(fragment) < trinaryHashSize {
+		fmt.Println("verify: tie-back transaction carries no Merkle commitment")
+		os.Exit(1)
+	}
+	embeddedRoot := Hash(fragment[:trinaryHashSize])
+	depthASCII, err := converter.TrytesToASCII(fragment[trinaryHashSize:])
+	must(err)
+	embeddedDepth, err := strconv.Atoi(strings.TrimRight(depthASCII, "\x00"))
+	must(err)
+
+	if embeddedRoot != tree.Root() {
+		fmt.Printf("verify: FAILED, computed root %s does not match embedded root %s\n", tree.Root(), embeddedRoot)
+		os.Exit(1)
+	}
+	if embeddedDepth != tree.Depth() {
+		fmt.Printf("verify: FAILED, computed depth %d does not match embedded depth %d\n", tree.Depth(), embeddedDepth)
+		os.Exit(1)
+	}
+
+	fmt.Printf("verify: OK, subtangle of %d txs matches tie-back root %s (depth %d)\n", len(subtangle), tree.Root(), tree.Depth())
+}
+
+const trinaryHashSize = 81